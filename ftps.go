@@ -0,0 +1,613 @@
+// Copyright 2020 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+// Package ftps implements a simple FTPS client.
+package ftps
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Client FTPS.
+type Client struct {
+	plain  net.Conn
+	secure *tls.Conn
+
+	tc *textproto.Conn
+
+	opt DialOptions
+
+	cmdMu  sync.Mutex
+	cmdErr error
+	closed bool
+	close  chan struct{}
+
+	// cccDone is set once CCCAfterAuth has downgraded the control
+	// connection to plaintext, so Close knows not to close the now-unused
+	// TLS layer over it.
+	cccDone bool
+
+	feat map[string]bool
+}
+
+// DialOptions for the FTPS client.
+type DialOptions struct {
+	Host     string
+	Port     int // If zero, this will default to 990.
+	Username string
+	Passowrd string
+
+	// If true, will connect un-encrypted, then upgrade to using AUTH TLS command.
+	ExplicitTLS bool
+
+	// If true, will NOT attempt to encrypt.
+	InsecureUnencrypted bool
+
+	KeepAlive time.Duration
+
+	TLSConfig *tls.Config
+
+	// ClientCertFile and ClientKeyFile name a PEM certificate and private
+	// key used for mutual TLS. ClientCertPEM and ClientKeyPEM provide the
+	// same material inline instead of from disk. At most one of the two
+	// forms may be set.
+	ClientCertFile string
+	ClientKeyFile  string
+	ClientCertPEM  []byte
+	ClientKeyPEM   []byte
+
+	// RootCAsPEM, if set, replaces TLSConfig.RootCAs with a pool parsed
+	// from this PEM data, used to verify the server's certificate.
+	RootCAsPEM []byte
+
+	// CCCAfterAuth issues the CCC command once AUTH TLS/USER/PASS succeed,
+	// downgrading the control connection back to plaintext while data
+	// connections continue to be encrypted via PROT P. This suits FTPS
+	// servers behind NAT that need to inspect or rewrite PASV responses on
+	// the control channel. Ignored if InsecureUnencrypted is set.
+	CCCAfterAuth bool
+}
+
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.FormatInt(int64(port), 10))
+}
+
+// Dial a FTPS server and return a Client.
+func Dial(ctx context.Context, opt DialOptions) (*Client, error) {
+	tlsConfig, err := effectiveTLSConfig(opt)
+	if err != nil {
+		return nil, fmt.Errorf("ftps: %w", err)
+	}
+	opt.TLSConfig = tlsConfig
+
+	// The client certificate and root CA material is now folded into
+	// TLSConfig above; clear it from opt so that redialing with this same
+	// Client's opt (as runSyncJobs does for concurrent workers) doesn't
+	// fold it in a second time on top of the already-effective config.
+	opt.ClientCertFile = ""
+	opt.ClientKeyFile = ""
+	opt.ClientCertPEM = nil
+	opt.ClientKeyPEM = nil
+	opt.RootCAsPEM = nil
+
+	port := opt.Port
+	if port <= 0 {
+		if opt.InsecureUnencrypted {
+			port = 21
+		} else {
+			port = 990
+		}
+	}
+	dialer := &net.Dialer{}
+	dialTo := joinHostPort(opt.Host, port)
+	conn, err := dialer.DialContext(ctx, "tcp", dialTo)
+	if err != nil {
+		return nil, fmt.Errorf("ftps: network dial failed: %w", err)
+	}
+
+	client := &Client{
+		plain: conn,
+		opt:   opt,
+		close: make(chan struct{}),
+	}
+
+	if err = client.setup(); err != nil {
+		client.plain.Close()
+		return nil, fmt.Errorf("ftps: connection setup failed: %w", err)
+	}
+	if opt.KeepAlive > 0 {
+		go client.asyncKeepAlive(opt.KeepAlive)
+	}
+
+	return client, nil
+}
+
+func (c *Client) setup() error {
+	if c.opt.ExplicitTLS {
+		c.tc = textproto.NewConn(c.plain)
+		if _, err := c.read(220); err != nil {
+			return fmt.Errorf("setup init read: %w", err)
+		}
+		if _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return err
+		}
+	}
+
+	if !c.opt.InsecureUnencrypted {
+		c.secure = tls.Client(c.plain, c.opt.TLSConfig)
+		if err := c.secure.Handshake(); err != nil {
+			return err
+		}
+		c.tc = textproto.NewConn(c.secure)
+	} else {
+		c.tc = textproto.NewConn(c.plain)
+	}
+
+	if !c.opt.ExplicitTLS {
+		if _, err := c.read(220); err != nil {
+			return fmt.Errorf("setup init read: %w", err)
+		}
+	}
+
+	if _, err := c.cmd(331, "USER %s", c.opt.Username); err != nil {
+		return err
+	}
+	if _, err := c.cmd(230, "PASS %s", c.opt.Passowrd); err != nil {
+		return err
+	}
+	if _, err := c.cmd(200, "TYPE I"); err != nil {
+		return err
+	}
+	if _, err := c.cmd(200, "PBSZ %d", 0); err != nil {
+		return err
+	}
+	if c.opt.InsecureUnencrypted {
+		return nil
+	}
+
+	if _, err := c.cmd(200, "PROT %s", "P"); err != nil {
+		return err
+	}
+
+	if c.opt.CCCAfterAuth {
+		if _, err := c.cmd(200, "CCC"); err != nil {
+			return fmt.Errorf("ftps: CCC failed: %w", err)
+		}
+		c.tc = textproto.NewConn(c.plain)
+		c.cccDone = true
+	}
+	return nil
+}
+
+// effectiveTLSConfig returns opt.TLSConfig augmented with any client
+// certificate and root CA material from opt, cloning the supplied config
+// (or starting from an empty one) so the caller's TLSConfig is left
+// untouched.
+func effectiveTLSConfig(opt DialOptions) (*tls.Config, error) {
+	var cfg *tls.Config
+	if opt.TLSConfig != nil {
+		cfg = opt.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+
+	cert, ok, err := clientCertificate(opt)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	if len(opt.RootCAsPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(opt.RootCAsPEM) {
+			return nil, fmt.Errorf("no certificates found in RootCAsPEM")
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// clientCertificate loads a client certificate for mutual TLS from either
+// the ClientCertFile/ClientKeyFile pair or the ClientCertPEM/ClientKeyPEM
+// pair, reporting ok false if neither is set.
+func clientCertificate(opt DialOptions) (cert tls.Certificate, ok bool, err error) {
+	switch {
+	case opt.ClientCertFile != "" || opt.ClientKeyFile != "":
+		if opt.ClientCertFile == "" || opt.ClientKeyFile == "" {
+			return tls.Certificate{}, false, fmt.Errorf("ClientCertFile and ClientKeyFile must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(opt.ClientCertFile, opt.ClientKeyFile)
+		if err != nil {
+			return tls.Certificate{}, false, fmt.Errorf("load client cert: %w", err)
+		}
+		return cert, true, nil
+	case len(opt.ClientCertPEM) > 0 || len(opt.ClientKeyPEM) > 0:
+		if len(opt.ClientCertPEM) == 0 || len(opt.ClientKeyPEM) == 0 {
+			return tls.Certificate{}, false, fmt.Errorf("ClientCertPEM and ClientKeyPEM must both be set")
+		}
+		cert, err := tls.X509KeyPair(opt.ClientCertPEM, opt.ClientKeyPEM)
+		if err != nil {
+			return tls.Certificate{}, false, fmt.Errorf("parse client cert: %w", err)
+		}
+		return cert, true, nil
+	default:
+		return tls.Certificate{}, false, nil
+	}
+}
+
+func (c *Client) read(expectCode int) (string, error) {
+	gotCode, message, err := c.tc.ReadResponse(expectCode)
+	if err != nil {
+		return "", fmt.Errorf("failed to read code, got code %d and message %s: %w", gotCode, message, err)
+	}
+	return message, nil
+}
+
+func (c *Client) asyncKeepAlive(dur time.Duration) {
+	if dur <= 0 {
+		return
+	}
+	tick := time.NewTicker(dur)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			ctx, cancel := context.WithTimeout(context.Background(), dur/2)
+			err := c.noop(ctx)
+			cancel()
+			if err != nil {
+				return
+			}
+		case <-c.close:
+			return
+		}
+	}
+}
+
+func (c *Client) cmd(expectedCode int, cmd string, args ...interface{}) (string, error) {
+	id, err := c.tc.Cmd(cmd, args...)
+	if err != nil {
+		return "", fmt.Errorf("cmd %q failed with ID %d: %w", cmd, id, err)
+	}
+
+	message, err := c.read(expectedCode)
+	if err != nil {
+		return "", fmt.Errorf("cmd %q failed read expected code %d with message %q: %w", cmd, expectedCode, message, err)
+	}
+
+	return message, nil
+}
+
+func (c *Client) data(ctx context.Context, expectedCode int, cmd string, args ...interface{}) (io.ReadWriteCloser, error) {
+	return c.dataAt(ctx, 0, expectedCode, cmd, args...)
+}
+
+// dataAt behaves like data, but first issues REST offset when offset is
+// greater than zero, so the following transfer command starts at that byte
+// position in the remote file.
+func (c *Client) dataAt(ctx context.Context, offset int64, expectedCode int, cmd string, args ...interface{}) (io.ReadWriteCloser, error) {
+	dconn, err := c.pasv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err = c.cmd(350, "REST %d", offset); err != nil {
+			dconn.Close()
+			return nil, err
+		}
+	}
+
+	_, err = c.cmd(expectedCode, cmd, args...)
+	if err != nil {
+		dconn.Close()
+		return nil, err
+	}
+
+	if c.opt.InsecureUnencrypted {
+		return dconn, nil
+	}
+	secure := tls.Client(dconn, c.opt.TLSConfig)
+
+	return secure, nil
+}
+
+// pasv asks the server to open a passive data port and dials it, returning
+// the raw (not yet TLS wrapped) data connection.
+func (c *Client) pasv(ctx context.Context) (net.Conn, error) {
+	message, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+
+	// Expected Message: Entering Passive Mode (x,x,x,x,p1,p2)
+	start := strings.Index(message, "(")
+	end := strings.LastIndex(message, ")")
+	if start < 0 || end < 0 || end < start {
+		return nil, fmt.Errorf("invalid PASV response, got %q", message)
+	}
+	portPartList := strings.Split(message[start+1:end], ",")
+	if len(portPartList) < 6 {
+		return nil, fmt.Errorf("invalid PASV port response, got %q", portPartList)
+	}
+	p1, err := strconv.ParseInt(portPartList[4], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	p2, err := strconv.ParseInt(portPartList[5], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	port := int(p1)*256 + int(p2)
+	// Ignore the IP address.
+
+	dialer := &net.Dialer{}
+	dconn, err := dialer.DialContext(ctx, "tcp", joinHostPort(c.opt.Host, port))
+	if err != nil {
+		return nil, fmt.Errorf("dial data conn failed: %w", err)
+	}
+	return dconn, nil
+}
+
+// features returns the set of capability keywords the server advertised in
+// its FEAT response (e.g. "MLSD", "XCRC"), querying the server once and
+// caching the result for the life of the connection.
+func (c *Client) features(ctx context.Context) (map[string]bool, error) {
+	if c.feat != nil {
+		return c.feat, nil
+	}
+	var feat map[string]bool
+	err := c.run(func() error {
+		message, err := c.cmd(211, "FEAT")
+		if err != nil {
+			return fmt.Errorf("ftps: FEAT failed: %w", err)
+		}
+		feat = map[string]bool{}
+		for _, line := range strings.Split(message, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "211") {
+				continue
+			}
+			feat[strings.ToUpper(strings.Fields(line)[0])] = true
+		}
+		c.feat = feat
+		return nil
+	})
+	return feat, err
+}
+
+// Close the FTPS client connection.
+func (c *Client) Close() error {
+	c.cmdMu.Lock()
+	cmdErr := c.cmdErr
+	if c.closed {
+		c.cmdMu.Unlock()
+		return cmdErr
+	}
+	c.closed = true
+	c.cmdMu.Unlock()
+
+	close(c.close)
+
+	_, qerr := c.cmd(221, "QUIT")
+	if c.secure != nil && !c.cccDone {
+		serr := c.secure.Close()
+		if cmdErr != nil {
+			return cmdErr
+		}
+		if serr != nil {
+			return serr
+		}
+		return qerr
+	}
+	c.plain.Close()
+	if cmdErr != nil {
+		return cmdErr
+	}
+	return qerr
+}
+
+// Getwd gets the current working directory.
+func (c *Client) Getwd() (dir string, err error) {
+	err = c.run(func() error {
+		dir, err = c.cmd(257, "PWD")
+		return err
+	})
+	return dir, err
+}
+
+// Chdir changes the current working directory.
+func (c *Client) Chdir(dir string) error {
+	return c.run(func() error {
+		if _, err := c.cmd(250, "CWD %s", dir); err != nil {
+			return fmt.Errorf("ftps: Chdir failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// Mkdir makes a new directory.
+func (c *Client) Mkdir(name string) error {
+	return c.run(func() error {
+		if _, err := c.cmd(257, "MKD %s", name); err != nil {
+			return fmt.Errorf("ftps: Mkdir failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// RemoveFile removes a file.
+func (c *Client) RemoveFile(name string) error {
+	return c.run(func() error {
+		if _, err := c.cmd(250, "DELE %s", name); err != nil {
+			return fmt.Errorf("ftps: RemoveFile failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// Size returns the size in bytes of name in the current working directory.
+func (c *Client) Size(name string) (int64, error) {
+	var size int64
+	err := c.run(func() error {
+		message, err := c.cmd(213, "SIZE %s", name)
+		if err != nil {
+			return fmt.Errorf("ftps: Size failed: %w", err)
+		}
+		size, err = strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+		if err != nil {
+			return fmt.Errorf("ftps: Size parse failed: %w", err)
+		}
+		return nil
+	})
+	return size, err
+}
+
+// RemoveDir removes a directory.
+func (c *Client) RemoveDir(name string) error {
+	return c.run(func() error {
+		if _, err := c.cmd(250, "RMD %s", name); err != nil {
+			return fmt.Errorf("ftps: RemoveDir failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// List the contents of the current working directory. It uses the RFC 3659
+// MLSD command when the server advertises support for it in FEAT, and falls
+// back to scraping LIST output otherwise.
+func (c *Client) List(ctx context.Context) ([]Entry, error) {
+	feat, err := c.features(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if feat["MLSD"] {
+		return c.ListMLSD(ctx)
+	}
+	return c.listLIST(ctx)
+}
+
+// listLIST is the List fallback for servers that don't support MLSD. It only
+// recovers each entry's Name and a best-effort Type, since UNIX ls -l output
+// has no standard machine-parsable format for the rest of Entry's fields.
+func (c *Client) listLIST(ctx context.Context) ([]Entry, error) {
+	var list []Entry
+	rerr := c.run(func() error {
+		data, err := c.data(ctx, 1, "LIST") // 150
+		if err != nil {
+			return fmt.Errorf("ftps: failed to List, unable to get data conn: %w", err)
+		}
+		defer data.Close()
+
+		reader := bufio.NewReader(data)
+		for {
+			select {
+			default:
+			case <-ctx.Done():
+				return fmt.Errorf("ftps: List canceled: %w", ctx.Err())
+			}
+			line, err := reader.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+
+			e, err := readLine(line)
+			if err != nil {
+				return fmt.Errorf("ftps: List line parse: %w", err)
+			}
+			list = append(list, e)
+		}
+		data.Close()
+
+		_, err = c.read(2) // 226
+		if err != nil {
+			return fmt.Errorf("ftps: List ack failed: %w", err)
+		}
+		return nil
+	})
+	return list, rerr
+}
+
+// readLine parses one line of UNIX-style LIST output into an Entry, reading
+// only the Name and a best-effort Type from the permission bits.
+func readLine(line string) (Entry, error) {
+	e := Entry{Type: EntryTypeFile}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "d") {
+		e.Type = EntryTypeDir
+	}
+
+	filenameIndex := 0
+	ct := 0
+	inSP := true
+	for index, r := range line {
+		sp := unicode.IsSpace(r)
+		if inSP == sp {
+			continue
+		}
+		inSP = sp
+		if sp {
+			continue
+		}
+		ct++
+
+		if ct == 9 {
+			filenameIndex = index
+			break
+		}
+	}
+	e.Name = line[filenameIndex:]
+	return e, nil
+}
+
+type runner func() error
+
+func (c *Client) run(f runner) error {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	cmdErr := c.cmdErr
+	if c.closed {
+		return cmdErr
+	}
+
+	err := f()
+	if err != nil {
+		c.cmdErr = err
+	}
+	return err
+}
+
+func (c *Client) noop(ctx context.Context) error {
+	return c.run(func() error {
+		_, err := c.cmd(200, "NOOP")
+		return err
+	})
+}
+
+// Upload the contents of Reader to the file name to the current working directory.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) error {
+	return c.UploadWith(ctx, name, r, TransferOptions{})
+}
+
+// Download the file name from the current working directory to the Writer.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) error {
+	return c.DownloadWith(ctx, name, w, TransferOptions{})
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EntryType is the RFC 3659 MLSx "Type" fact: file, dir, cdir (the listed
+// directory itself), pdir (its parent), or OS.unix=symlink.
+type EntryType string
+
+// Known EntryType values.
+const (
+	EntryTypeFile    EntryType = "file"
+	EntryTypeDir     EntryType = "dir"
+	EntryTypeCDir    EntryType = "cdir"
+	EntryTypePDir    EntryType = "pdir"
+	EntryTypeSymlink EntryType = "OS.unix=symlink"
+)
+
+// Entry describes one file or directory, as returned by List, ListMLSD and
+// Stat. Only Name and Type are guaranteed to be set when the entry came from
+// the LIST fallback rather than MLSD/MLST; the rest are parsed from MLSx
+// facts and are left at their zero value when a server doesn't advertise
+// them.
+type Entry struct {
+	Name   string
+	Size   int64
+	Modify time.Time
+	Type   EntryType
+
+	Perm     string
+	UniqueID string
+
+	UnixMode  string
+	UnixOwner string
+	UnixGroup string
+}
+
+// ListMLSD lists the contents of the current working directory using the
+// RFC 3659 MLSD command.
+func (c *Client) ListMLSD(ctx context.Context) ([]Entry, error) {
+	var list []Entry
+	rerr := c.run(func() error {
+		data, err := c.data(ctx, 1, "MLSD") // 150
+		if err != nil {
+			return fmt.Errorf("ftps: failed to ListMLSD, unable to get data conn: %w", err)
+		}
+		defer data.Close()
+
+		reader := bufio.NewReader(data)
+		for {
+			select {
+			default:
+			case <-ctx.Done():
+				return fmt.Errorf("ftps: ListMLSD canceled: %w", ctx.Err())
+			}
+			line, err := reader.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("ftps: ListMLSD read: %w", err)
+			}
+
+			e, err := parseMLSxLine(line)
+			if err != nil {
+				return fmt.Errorf("ftps: ListMLSD parse: %w", err)
+			}
+			// cdir and pdir facts describe the listed directory itself and
+			// its parent, not children; many real servers (vsftpd, ProFTPD,
+			// Pure-FTPd) emit them for "." and "..", which callers don't
+			// expect to see among a directory's contents.
+			if e.Type == EntryTypeCDir || e.Type == EntryTypePDir {
+				continue
+			}
+			list = append(list, e)
+		}
+		data.Close()
+
+		_, err = c.read(2) // 226
+		if err != nil {
+			return fmt.Errorf("ftps: ListMLSD ack failed: %w", err)
+		}
+		return nil
+	})
+	return list, rerr
+}
+
+// Stat returns structured metadata for name in the current working
+// directory, using the RFC 3659 MLST command. ctx is checked only before the
+// command is sent: like Size and Mkdir, this is a single control-command
+// round trip with no data connection of its own, and an MLST already in
+// flight is not interrupted by canceling ctx.
+func (c *Client) Stat(ctx context.Context, name string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	err := c.run(func() error {
+		message, cerr := c.cmd(250, "MLST %s", name)
+		if cerr != nil {
+			return fmt.Errorf("ftps: Stat failed: %w", cerr)
+		}
+		for _, line := range strings.Split(message, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || !strings.Contains(line, "=") {
+				continue
+			}
+			e, cerr = parseMLSxLine(line)
+			return cerr
+		}
+		return fmt.Errorf("ftps: Stat: no facts in MLST response %q", message)
+	})
+	return e, err
+}
+
+// parseMLSxLine parses one "fact=value;fact=value; name" line as produced by
+// MLSD and MLST.
+func parseMLSxLine(line string) (Entry, error) {
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return Entry{}, fmt.Errorf("malformed MLSx line %q", line)
+	}
+
+	e := Entry{Name: parts[1]}
+	for _, fact := range strings.Split(parts[0], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.ToLower(kv[0]), kv[1]
+		switch key {
+		case "size":
+			e.Size, _ = strconv.ParseInt(val, 10, 64)
+		case "modify":
+			e.Modify, _ = time.Parse("20060102150405", val)
+		case "type":
+			e.Type = EntryType(val)
+		case "perm":
+			e.Perm = val
+		case "unique":
+			e.UniqueID = val
+		case "unix.mode":
+			e.UnixMode = val
+		case "unix.owner":
+			e.UnixOwner = val
+		case "unix.group":
+			e.UnixGroup = val
+		}
+	}
+	return e, nil
+}
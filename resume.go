@@ -0,0 +1,430 @@
+// Copyright 2020 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResumeOptions configures DownloadResume.
+type ResumeOptions struct {
+	// PartFile overrides the sidecar state file that records completed byte
+	// ranges. Defaults to the remote file's base name with a ".ftps-part"
+	// suffix, in the current directory.
+	PartFile string
+
+	// VerifyChecksum compares the downloaded data against a server-side
+	// checksum, using whichever of XCRC or HASH the server advertises in
+	// FEAT. Ignored if the server advertises neither, or if w does not also
+	// implement io.ReaderAt.
+	VerifyChecksum bool
+}
+
+// byteRange is a half-open [Start, End) span of a file.
+type byteRange struct {
+	Start, End int64
+}
+
+func (r byteRange) size() int64 { return r.End - r.Start }
+
+// DownloadResume downloads remotePath into w, resuming from a sidecar state
+// file if a previous call was interrupted. Completed ranges are recorded as
+// they finish, so a later call only re-fetches the missing extents.
+func (c *Client) DownloadResume(ctx context.Context, remotePath string, w io.WriterAt, opts ResumeOptions) error {
+	total, err := c.Size(remotePath)
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadResume size: %w", err)
+	}
+
+	partFile := opts.PartFile
+	if partFile == "" {
+		partFile = path.Base(remotePath) + ".ftps-part"
+	}
+
+	done, err := loadPartState(partFile)
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadResume state: %w", err)
+	}
+
+	for _, missing := range gaps(byteRange{End: total}, done) {
+		if err := c.downloadRange(ctx, remotePath, w, missing); err != nil {
+			return fmt.Errorf("ftps: DownloadResume: %w", err)
+		}
+		done = append(done, missing)
+		if err := savePartState(partFile, done); err != nil {
+			return fmt.Errorf("ftps: DownloadResume state: %w", err)
+		}
+	}
+
+	if opts.VerifyChecksum {
+		if err := c.verifyChecksum(ctx, remotePath, w, total); err != nil {
+			return fmt.Errorf("ftps: DownloadResume checksum: %w", err)
+		}
+	}
+
+	if err := os.Remove(partFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ftps: DownloadResume cleanup: %w", err)
+	}
+	return nil
+}
+
+// DownloadParallel fetches remotePath into localPath using up to segments
+// concurrent data connections. A single FTP control connection can only
+// drive one data transfer at a time, so each segment dials its own Client,
+// re-negotiating AUTH/PBSZ/PROT independently of c. Progress is recorded in
+// a ".ftps-part" sidecar next to localPath, so a later call only retries the
+// segments that did not finish.
+func (c *Client) DownloadParallel(ctx context.Context, remotePath, localPath string, segments int) error {
+	total, err := c.Size(remotePath)
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadParallel size: %w", err)
+	}
+	cwd, err := c.Getwd()
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadParallel getwd: %w", err)
+	}
+	cwd = parsePWD(cwd)
+
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadParallel open: %w", err)
+	}
+	defer f.Close()
+
+	partFile := localPath + ".ftps-part"
+	done, err := loadPartState(partFile)
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadParallel state: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	// alreadyDone is a snapshot of done taken before any goroutine starts
+	// mutating it, so the dispatch loop below never reads the slice
+	// concurrently with the writes under mu in the goroutines it spawns.
+	alreadyDone := append([]byteRange(nil), done...)
+	for _, rng := range splitRanges(total, segments) {
+		if rangeDone(alreadyDone, rng) {
+			continue
+		}
+		rng := rng
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.downloadSegment(ctx, cwd, remotePath, f, rng)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			done = append(done, rng)
+			if serr := savePartState(partFile, done); serr != nil && firstErr == nil {
+				firstErr = serr
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return fmt.Errorf("ftps: DownloadParallel: %w", firstErr)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadParallel stat: %w", err)
+	}
+	if fi.Size() != total {
+		return fmt.Errorf("ftps: DownloadParallel size mismatch: got %d, want %d", fi.Size(), total)
+	}
+	return os.Remove(partFile)
+}
+
+// parsePWD extracts the quoted path out of a PWD response such as
+// `"/d1" is the current directory`.
+func parsePWD(message string) string {
+	start := strings.Index(message, `"`)
+	end := strings.LastIndex(message, `"`)
+	if start < 0 || end <= start {
+		return message
+	}
+	return message[start+1 : end]
+}
+
+// downloadSegment dials a dedicated connection for one range of remotePath
+// so it can proceed concurrently with other segments, changing to cwd first
+// since a freshly dialed connection always starts at the server's root.
+func (c *Client) downloadSegment(ctx context.Context, cwd, remotePath string, w io.WriterAt, rng byteRange) error {
+	seg, err := Dial(ctx, c.opt)
+	if err != nil {
+		return fmt.Errorf("segment dial: %w", err)
+	}
+	defer seg.Close()
+
+	if cwd != "" && cwd != "/" {
+		if err := seg.Chdir(cwd); err != nil {
+			return fmt.Errorf("segment chdir: %w", err)
+		}
+	}
+
+	return seg.downloadRange(ctx, remotePath, w, rng)
+}
+
+// downloadRange fetches the half-open byte range rng of remotePath into w at
+// the matching offset, restarting the transfer via REST when rng.Start is
+// greater than zero.
+func (c *Client) downloadRange(ctx context.Context, remotePath string, w io.WriterAt, rng byteRange) error {
+	return c.run(func() error {
+		data, err := c.dataAt(ctx, rng.Start, 1, "RETR %s", remotePath) // 150
+		if err != nil {
+			return fmt.Errorf("range data: %w", err)
+		}
+		defer data.Close()
+
+		n, err := io.CopyN(&offsetWriter{w: w, off: rng.Start}, data, rng.size())
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("range copy: %w", err)
+		}
+		if n != rng.size() {
+			return fmt.Errorf("range copy: got %d bytes, want %d", n, rng.size())
+		}
+		data.Close()
+
+		return c.readRangeAck()
+	})
+}
+
+// readRangeAck reads the response that follows a RETR. A range that ends
+// before the remote file's end intentionally stops reading early, which
+// commonly makes the server answer 426 (transfer aborted) rather than 226;
+// both are treated as success.
+func (c *Client) readRangeAck() error {
+	gotCode, message, err := c.tc.ReadResponse(2)
+	if err == nil {
+		return nil
+	}
+	if gotCode == 426 {
+		return nil
+	}
+	return fmt.Errorf("range ack, got code %d and message %s: %w", gotCode, message, err)
+}
+
+// offsetWriter adapts an io.WriterAt to io.Writer, writing sequentially
+// starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// splitRanges divides [0, total) into up to n contiguous ranges.
+func splitRanges(total int64, n int) []byteRange {
+	if n < 1 {
+		n = 1
+	}
+	if int64(n) > total {
+		n = int(total)
+	}
+	if n < 1 {
+		n = 1
+	}
+	chunk := total / int64(n)
+	ranges := make([]byteRange, 0, n)
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + chunk
+		if i == n-1 {
+			end = total
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+		start = end
+	}
+	return ranges
+}
+
+func rangeDone(done []byteRange, rng byteRange) bool {
+	for _, d := range done {
+		if d == rng {
+			return true
+		}
+	}
+	return false
+}
+
+// gaps returns the portions of whole not covered by any range in done.
+func gaps(whole byteRange, done []byteRange) []byteRange {
+	if len(done) == 0 {
+		if whole.size() <= 0 {
+			return nil
+		}
+		return []byteRange{whole}
+	}
+
+	sorted := append([]byteRange(nil), done...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var out []byteRange
+	cursor := whole.Start
+	for _, d := range sorted {
+		if d.End <= cursor || d.Start >= whole.End {
+			continue
+		}
+		if d.Start > cursor {
+			out = append(out, byteRange{Start: cursor, End: d.Start})
+		}
+		if d.End > cursor {
+			cursor = d.End
+		}
+	}
+	if cursor < whole.End {
+		out = append(out, byteRange{Start: cursor, End: whole.End})
+	}
+	return out
+}
+
+// loadPartState reads the sidecar file produced by savePartState. A missing
+// file means no progress has been made yet.
+func loadPartState(name string) ([]byteRange, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []byteRange
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed part state line %q", line)
+		}
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+// savePartState writes the set of completed ranges to the sidecar file.
+func savePartState(name string, ranges []byteRange) error {
+	var sb strings.Builder
+	for _, r := range ranges {
+		fmt.Fprintf(&sb, "%d %d\n", r.Start, r.End)
+	}
+	return os.WriteFile(name, []byte(sb.String()), 0o644)
+}
+
+// verifyChecksum compares the downloaded data in w against a server-side
+// checksum, preferring XCRC and falling back to HASH.
+func (c *Client) verifyChecksum(ctx context.Context, remotePath string, w io.WriterAt, total int64) error {
+	ra, ok := w.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+
+	feat, err := c.features(ctx)
+	if err != nil {
+		return err
+	}
+
+	var algo, remote string
+	switch {
+	case feat["XCRC"]:
+		algo = "crc32"
+		err = c.run(func() error {
+			message, cerr := c.cmd(250, "XCRC %s", remotePath)
+			if cerr != nil {
+				return cerr
+			}
+			fields := strings.Fields(message)
+			if len(fields) == 0 {
+				return fmt.Errorf("malformed XCRC response %q", message)
+			}
+			remote = fields[0]
+			return nil
+		})
+	case feat["HASH"]:
+		algo = "md5"
+		err = c.run(func() error {
+			message, cerr := c.cmd(213, "HASH %s", remotePath)
+			if cerr != nil {
+				return cerr
+			}
+			fields := strings.Fields(message)
+			if len(fields) == 0 {
+				return fmt.Errorf("malformed HASH response %q", message)
+			}
+			remote = strings.ToLower(fields[len(fields)-1])
+			return nil
+		})
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("remote checksum: %w", err)
+	}
+
+	local, err := localChecksum(algo, io.NewSectionReader(ra, 0, total))
+	if err != nil {
+		return fmt.Errorf("local checksum: %w", err)
+	}
+	if !strings.EqualFold(local, remote) {
+		return fmt.Errorf("checksum mismatch, local %s remote %s", local, remote)
+	}
+	return nil
+}
+
+func localChecksum(algo string, r io.Reader) (string, error) {
+	switch algo {
+	case "crc32":
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(h, r); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%08x", h.Sum32()), nil
+	default:
+		h := md5.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
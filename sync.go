@@ -0,0 +1,503 @@
+// Copyright 2020 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SkipDir is used as a return value from Walk's fn to indicate that the
+// directory named in the call is to be skipped, mirroring filepath.SkipDir.
+var SkipDir = errors.New("ftps: skip this directory")
+
+// Walk walks the remote file tree rooted at root, relative to the current
+// working directory, calling fn for each file or directory beneath root. fn
+// is not called for root itself, unless root cannot be entered, in which
+// case fn receives root and that error. A non-nil error from fn stops the
+// walk and is returned, except SkipDir returned for a directory, which skips
+// that directory's contents.
+func (c *Client) Walk(ctx context.Context, root string, fn func(path string, info Entry, err error) error) error {
+	start, err := c.Getwd()
+	if err != nil {
+		return fmt.Errorf("ftps: Walk getwd: %w", err)
+	}
+	start = parsePWD(start)
+
+	if err := c.Chdir(root); err != nil {
+		return fn(root, Entry{Name: path.Base(root), Type: EntryTypeDir}, err)
+	}
+	defer c.Chdir(start)
+
+	return c.walk(ctx, root, fn)
+}
+
+func (c *Client) walk(ctx context.Context, dir string, fn func(path string, info Entry, err error) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entries, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name)
+		if e.Type != EntryTypeDir {
+			if err := fn(p, e, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch err := fn(p, e, nil); {
+		case err == SkipDir:
+			continue
+		case err != nil:
+			return err
+		}
+
+		if err := c.Chdir(e.Name); err != nil {
+			return fmt.Errorf("ftps: Walk chdir %s: %w", p, err)
+		}
+		err := c.walk(ctx, p, fn)
+		if cerr := c.Chdir(".."); cerr != nil && err == nil {
+			err = fmt.Errorf("ftps: Walk chdir ..: %w", cerr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAll recursively removes name and everything beneath it. If name is a
+// plain file, it behaves like RemoveFile.
+func (c *Client) RemoveAll(ctx context.Context, name string) error {
+	entries, err := c.List(ctx)
+	if err != nil {
+		return fmt.Errorf("ftps: RemoveAll list: %w", err)
+	}
+	isDir := false
+	for _, e := range entries {
+		if e.Name == name {
+			isDir = e.Type == EntryTypeDir
+			break
+		}
+	}
+	if !isDir {
+		return c.RemoveFile(name)
+	}
+
+	start, err := c.Getwd()
+	if err != nil {
+		return fmt.Errorf("ftps: RemoveAll getwd: %w", err)
+	}
+	start = parsePWD(start)
+
+	if err := c.Chdir(name); err != nil {
+		return fmt.Errorf("ftps: RemoveAll chdir %s: %w", name, err)
+	}
+
+	err = c.removeChildren(ctx)
+	if cerr := c.Chdir(start); cerr != nil && err == nil {
+		err = fmt.Errorf("ftps: RemoveAll chdir back: %w", cerr)
+	}
+	if err != nil {
+		return fmt.Errorf("ftps: RemoveAll %s: %w", name, err)
+	}
+
+	return c.RemoveDir(name)
+}
+
+// removeChildren deletes everything in the current working directory,
+// descending into subdirectories depth-first so they're empty before RMD.
+func (c *Client) removeChildren(ctx context.Context) error {
+	entries, err := c.List(ctx)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.Type != EntryTypeDir {
+			if err := c.RemoveFile(e.Name); err != nil {
+				return fmt.Errorf("remove %s: %w", e.Name, err)
+			}
+			continue
+		}
+
+		if err := c.Chdir(e.Name); err != nil {
+			return fmt.Errorf("chdir %s: %w", e.Name, err)
+		}
+		err := c.removeChildren(ctx)
+		if cerr := c.Chdir(".."); cerr != nil && err == nil {
+			err = fmt.Errorf("chdir ..: %w", cerr)
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.RemoveDir(e.Name); err != nil {
+			return fmt.Errorf("rmdir %s: %w", e.Name, err)
+		}
+	}
+	return nil
+}
+
+// SyncOptions configures UploadDir and DownloadDir.
+type SyncOptions struct {
+	// Include, if non-empty, restricts the sync to files whose base name
+	// matches at least one of these path.Match patterns.
+	Include []string
+
+	// Exclude skips files and directories whose base name matches any of
+	// these path.Match patterns.
+	Exclude []string
+
+	// SkipUpToDate skips a file when the destination already has it with a
+	// modification time no older than the source's, determined from the
+	// remote MLST/MLSD "modify" fact and the local file's ModTime. A file
+	// whose remote entry carries no modify fact is always transferred.
+	SkipUpToDate bool
+
+	// FollowSymlinks controls how UploadDir treats local symlinks and how
+	// DownloadDir treats remote entries advertising EntryTypeSymlink. If
+	// false (the default), symlinks are skipped. If true, each symlink is
+	// transferred as a single file with its target's contents; a symlink to
+	// a directory is not walked, and transferring it fails.
+	FollowSymlinks bool
+
+	// Concurrency is the number of files transferred at once, each over its
+	// own dialed connection. Values less than 2 transfer one file at a time
+	// over the Client the call was made on.
+	Concurrency int
+}
+
+// allowed reports whether name passes opts' Include and Exclude filters.
+// Include applies to files only, so dir entries are checked against Exclude
+// alone.
+func (o SyncOptions) allowed(name string, dir bool) bool {
+	if len(o.Include) > 0 && !dir {
+		matched := false
+		for _, pat := range o.Include {
+			if ok, _ := path.Match(pat, name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, pat := range o.Exclude {
+		if ok, _ := path.Match(pat, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// syncJob is one file to transfer, queued by the sequential planning pass
+// and executed by runSyncJobs, possibly on a worker connection of its own.
+type syncJob struct {
+	// remoteDir is the directory the file lives in, relative to the
+	// destination root, using forward slashes; "" means the root itself.
+	remoteDir string
+	name      string
+	localPath string
+}
+
+// runSyncJobs executes jobs with the given concurrency, serializing
+// control-channel commands with a mutex on each connection: concurrency <= 1
+// reuses c directly, while higher values dial one connection per worker so
+// transfers proceed over genuinely separate data connections. Each job cds
+// to root/job.remoteDir anchored at c's current directory rather than
+// wherever the previous job left the connection, since jobs for different
+// subdirectories are interleaved in no particular order.
+func (c *Client) runSyncJobs(ctx context.Context, root string, concurrency int, jobs []syncJob, do func(conn *Client, j syncJob) error) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(jobs) {
+		concurrency = len(jobs)
+	}
+
+	anchor, err := c.Getwd()
+	if err != nil {
+		return fmt.Errorf("getwd: %w", err)
+	}
+	anchor = parsePWD(anchor)
+
+	if concurrency == 1 {
+		for _, j := range jobs {
+			if err := c.gotoDir(anchor, root, j.remoteDir); err != nil {
+				return err
+			}
+			if err := do(c, j); err != nil {
+				return err
+			}
+		}
+		return c.Chdir(anchor)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan syncJob)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := Dial(ctx, c.opt)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("worker dial: %w", err)
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			defer conn.Close()
+
+			for j := range queue {
+				err := conn.gotoDir(anchor, root, j.remoteDir)
+				if err == nil {
+					err = do(conn, j)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, j := range jobs {
+		select {
+		case queue <- j:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
+
+// gotoDir changes conn's working directory to anchor/root/sub, using the
+// full path each time so it doesn't matter where a previous job left conn:
+// a freshly dialed worker starts at the server's own root, while c itself
+// may be left anywhere by the previous job. sub uses forward slashes and
+// may be empty.
+func (c *Client) gotoDir(anchor, root, sub string) error {
+	dir := path.Join(anchor, root)
+	if sub != "" {
+		dir = path.Join(dir, sub)
+	}
+	return c.Chdir(dir)
+}
+
+// UploadDir mirrors the local directory tree at localDir into remoteDir,
+// creating remote directories as needed.
+func (c *Client) UploadDir(ctx context.Context, localDir, remoteDir string, opts SyncOptions) error {
+	if err := c.mkdirAll(ctx, remoteDir); err != nil {
+		return fmt.Errorf("ftps: UploadDir mkdir %s: %w", remoteDir, err)
+	}
+
+	var jobs []syncJob
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == localDir {
+			return nil
+		}
+		if !opts.allowed(info.Name(), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 && !opts.FollowSymlinks {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			return c.mkdirAll(ctx, path.Join(remoteDir, rel))
+		}
+
+		if opts.SkipUpToDate {
+			if remote, err := c.Stat(ctx, path.Join(remoteDir, rel)); err == nil && !remote.Modify.IsZero() {
+				if !info.ModTime().After(remote.Modify) {
+					return nil
+				}
+			}
+		}
+
+		dirRel := path.Dir(rel)
+		if dirRel == "." {
+			dirRel = ""
+		}
+		jobs = append(jobs, syncJob{
+			remoteDir: dirRel,
+			name:      info.Name(),
+			localPath: p,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ftps: UploadDir walk: %w", err)
+	}
+
+	return c.runSyncJobs(ctx, remoteDir, opts.Concurrency, jobs, func(conn *Client, j syncJob) error {
+		f, err := os.Open(j.localPath)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", j.localPath, err)
+		}
+		defer f.Close()
+
+		if err := conn.Upload(ctx, j.name, f); err != nil {
+			return fmt.Errorf("upload %s: %w", j.localPath, err)
+		}
+		return nil
+	})
+}
+
+// mkdirAll ensures dir exists relative to the current working directory,
+// creating intermediate path segments as needed and leaving the working
+// directory unchanged. Existence is checked with List rather than a trial
+// Chdir, since a failed command lingers as the error Close eventually
+// reports, and a missing intermediate directory is the expected case here,
+// not a failure worth remembering.
+func (c *Client) mkdirAll(ctx context.Context, dir string) error {
+	start, err := c.Getwd()
+	if err != nil {
+		return fmt.Errorf("getwd: %w", err)
+	}
+	start = parsePWD(start)
+	defer c.Chdir(start)
+
+	for _, seg := range strings.Split(dir, "/") {
+		if seg == "" {
+			continue
+		}
+		entries, err := c.List(ctx)
+		if err != nil {
+			return fmt.Errorf("list: %w", err)
+		}
+		exists := false
+		for _, e := range entries {
+			if e.Name == seg && e.Type == EntryTypeDir {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			if err := c.Mkdir(seg); err != nil {
+				return fmt.Errorf("mkdir %s: %w", seg, err)
+			}
+		}
+		if err := c.Chdir(seg); err != nil {
+			return fmt.Errorf("chdir %s: %w", seg, err)
+		}
+	}
+	return nil
+}
+
+// DownloadDir mirrors the remote directory tree at remoteDir into localDir,
+// creating local directories as needed.
+func (c *Client) DownloadDir(ctx context.Context, remoteDir, localDir string, opts SyncOptions) error {
+	if err := os.MkdirAll(localDir, 0o755); err != nil {
+		return fmt.Errorf("ftps: DownloadDir mkdir %s: %w", localDir, err)
+	}
+
+	var jobs []syncJob
+	err := c.Walk(ctx, remoteDir, func(p string, info Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !opts.allowed(info.Name, info.Type == EntryTypeDir) {
+			if info.Type == EntryTypeDir {
+				return SkipDir
+			}
+			return nil
+		}
+		if info.Type == EntryTypeSymlink && !opts.FollowSymlinks {
+			return nil
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, remoteDir), "/")
+
+		if info.Type == EntryTypeDir {
+			return os.MkdirAll(filepath.Join(localDir, filepath.FromSlash(rel)), 0o755)
+		}
+
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+		if opts.SkipUpToDate && !info.Modify.IsZero() {
+			if fi, err := os.Stat(localPath); err == nil && !info.Modify.After(fi.ModTime()) {
+				return nil
+			}
+		}
+
+		dirRel := path.Dir(rel)
+		if dirRel == "." {
+			dirRel = ""
+		}
+		jobs = append(jobs, syncJob{
+			remoteDir: dirRel,
+			name:      info.Name,
+			localPath: localPath,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ftps: DownloadDir walk: %w", err)
+	}
+
+	return c.runSyncJobs(ctx, remoteDir, opts.Concurrency, jobs, func(conn *Client, j syncJob) error {
+		f, err := os.Create(j.localPath)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", j.localPath, err)
+		}
+		defer f.Close()
+
+		if err := conn.Download(ctx, j.name, f); err != nil {
+			return fmt.Errorf("download %s: %w", j.localPath, err)
+		}
+		return nil
+	})
+}
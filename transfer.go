@@ -0,0 +1,287 @@
+// Copyright 2020 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package ftps
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultChunkSize bounds how much data is read or written between checks of
+// ctx and the rate limiter, so both stay responsive during a large transfer.
+const defaultChunkSize = 32 * 1024
+
+// TransferOptions configures UploadWith and DownloadWith.
+type TransferOptions struct {
+	// OnProgress, when set, is called as the transfer proceeds with the
+	// number of bytes moved so far and the total size, or -1 if the total
+	// could not be determined.
+	OnProgress func(bytes, total int64)
+
+	// ReportInterval limits how often OnProgress is called. Zero reports
+	// after every chunk. The final call always happens regardless of
+	// ReportInterval.
+	ReportInterval time.Duration
+
+	// MaxBytesPerSec throttles the transfer to roughly this many bytes per
+	// second. Zero or negative means unlimited.
+	MaxBytesPerSec int64
+}
+
+// UploadWith uploads the contents of r to name in the current working
+// directory, like Upload, additionally reporting progress and throttling
+// according to opts. Total size is read from r via io.Seeker when available,
+// and is -1 otherwise.
+func (c *Client) UploadWith(ctx context.Context, name string, r io.Reader, opts TransferOptions) error {
+	total := seekerSize(r)
+
+	return c.run(func() error {
+		data, err := c.data(ctx, 1, "STOR %s", name) // 150
+		if err != nil {
+			return fmt.Errorf("upload data: %w", err)
+		}
+		defer data.Close()
+
+		metered := &meteredConn{ReadWriteCloser: data, m: newMeter(ctx, total, opts)}
+
+		_, err = io.Copy(metered, r)
+		if err != nil {
+			return fmt.Errorf("upload copy: %w", err)
+		}
+		metered.m.advance(0, true)
+
+		if err = data.Close(); err != nil {
+			return fmt.Errorf("upload close: %w", err)
+		}
+		_, err = c.read(2) // 226
+		if err != nil {
+			return fmt.Errorf("upload read: %w", err)
+		}
+		return nil
+	})
+}
+
+// DownloadWith downloads name from the current working directory into w,
+// like Download, additionally reporting progress and throttling according to
+// opts. Total size is read via SIZE.
+func (c *Client) DownloadWith(ctx context.Context, name string, w io.Writer, opts TransferOptions) error {
+	total, err := c.Size(name)
+	if err != nil {
+		total = -1
+	}
+
+	return c.run(func() error {
+		data, err := c.data(ctx, 1, "RETR %s", name) // 150
+		if err != nil {
+			return fmt.Errorf("download data: %w", err)
+		}
+		defer data.Close()
+
+		metered := &meteredConn{ReadWriteCloser: data, m: newMeter(ctx, total, opts)}
+
+		_, err = io.Copy(w, metered)
+		if err != nil {
+			return fmt.Errorf("download copy: %w", err)
+		}
+		metered.m.advance(0, true)
+		data.Close()
+
+		_, err = c.read(2) // 226
+		if err != nil {
+			return fmt.Errorf("download read: %w", err)
+		}
+		return nil
+	})
+}
+
+// seekerSize returns the number of unread bytes left in r via io.Seeker,
+// or -1 if r doesn't support seeking.
+func seekerSize(r io.Reader) int64 {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return -1
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	if _, err := s.Seek(cur, io.SeekStart); err != nil {
+		return -1
+	}
+	return end - cur
+}
+
+// meter tracks transfer progress and optional throttling for one call to
+// UploadWith or DownloadWith.
+type meter struct {
+	ctx    context.Context
+	total  int64
+	opts   TransferOptions
+	bucket *tokenBucket
+
+	done     int64
+	lastCall time.Time
+
+	// finalReported is set once the final OnProgress call has gone out, so
+	// an explicit final call (from UploadWith/DownloadWith after io.Copy
+	// returns) doesn't duplicate one already made because total was known.
+	finalReported bool
+}
+
+func newMeter(ctx context.Context, total int64, opts TransferOptions) *meter {
+	var bucket *tokenBucket
+	if opts.MaxBytesPerSec > 0 {
+		bucket = newTokenBucket(opts.MaxBytesPerSec)
+	}
+	return &meter{ctx: ctx, total: total, opts: opts, bucket: bucket}
+}
+
+func (m *meter) throttle(n int) error {
+	if m.bucket == nil {
+		return nil
+	}
+	return m.bucket.wait(m.ctx, n)
+}
+
+// chunkSize returns how much data a single Read or Write should move at a
+// time: the smaller of defaultChunkSize and the rate limit itself, so that a
+// single chunk never asks the bucket for more tokens than it can ever hold.
+func (m *meter) chunkSize() int {
+	limit := defaultChunkSize
+	if m.bucket != nil && int(m.bucket.ratePerSec) < limit {
+		limit = int(m.bucket.ratePerSec)
+		if limit < 1 {
+			limit = 1
+		}
+	}
+	return limit
+}
+
+// advance records n more bytes moved and, subject to ReportInterval, calls
+// OnProgress. final marks the call made once the transfer has finished
+// copying, forcing a report regardless of ReportInterval and regardless of
+// whether total was ever known, per TransferOptions.ReportInterval's doc.
+func (m *meter) advance(n int, final bool) {
+	m.done += int64(n)
+	if m.opts.OnProgress == nil || m.finalReported {
+		return
+	}
+
+	finished := final || (m.total >= 0 && m.done >= m.total)
+	now := time.Now()
+	if !finished && m.opts.ReportInterval > 0 && now.Sub(m.lastCall) < m.opts.ReportInterval {
+		return
+	}
+	m.lastCall = now
+	m.opts.OnProgress(m.done, m.total)
+	if finished {
+		m.finalReported = true
+	}
+}
+
+// meteredConn wraps an FTP data connection, reporting progress through m and
+// pacing reads and writes to m's rate limit, in chunks small enough to keep
+// ctx cancellation responsive.
+type meteredConn struct {
+	io.ReadWriteCloser
+	m *meter
+}
+
+func (mc *meteredConn) Read(p []byte) (int, error) {
+	if err := mc.m.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if chunk := mc.m.chunkSize(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := mc.ReadWriteCloser.Read(p)
+	if n > 0 {
+		if werr := mc.m.throttle(n); werr != nil {
+			return n, werr
+		}
+		mc.m.advance(n, false)
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := mc.m.ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := p
+		if limit := mc.m.chunkSize(); len(chunk) > limit {
+			chunk = chunk[:limit]
+		}
+		if err := mc.m.throttle(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := mc.ReadWriteCloser.Write(chunk)
+		written += n
+		mc.m.advance(n, false)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// tokenBucket is a simple token-bucket rate limiter measured in bytes per
+// second.
+type tokenBucket struct {
+	ratePerSec int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(ratePerSec int64) *tokenBucket {
+	return &tokenBucket{
+		ratePerSec: ratePerSec,
+		tokens:     float64(ratePerSec),
+		last:       time.Now(),
+	}
+}
+
+// wait blocks until n bytes are available in the bucket, refilling it based
+// on elapsed time, or until ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	need := float64(n)
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.ratePerSec)
+		if b.tokens > float64(b.ratePerSec) {
+			b.tokens = float64(b.ratePerSec)
+		}
+		b.last = now
+
+		if b.tokens >= need {
+			b.tokens -= need
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((need - b.tokens) / float64(b.ratePerSec) * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}